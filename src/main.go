@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "github.com/prometheus/client_golang/prometheus/promhttp"
+	"go-temp/publisher"
 	"go-temp/rabbitmq"
 	"go-temp/utils"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -34,11 +39,17 @@ var (
 		Name: "sensor_messages_published_total",
 		Help: "Total number of messages published to RabbitMQ",
 	})
+
+	brokerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_up",
+		Help: "Whether a publish target's broker connection is currently healthy (1) or not (0)",
+	}, []string{"target"})
 )
 
 func init() {
 	prometheus.MustRegister(tempGauge)
 	prometheus.MustRegister(msgCount)
+	prometheus.MustRegister(brokerUp)
 }
 
 func readTemperature(sensorPath string) (float64, error) {
@@ -87,81 +98,454 @@ func getEnvBool(key string, defaultVal bool) bool {
 	return parsed
 }
 
-var healthy = true
+// publishTargetNames returns the configured publish target names from
+// PUBLISH_TARGETS, a comma-separated list (e.g. "local,remote,nats1"). If
+// PUBLISH_TARGETS isn't set, it falls back to the pre-PUBLISH_TARGETS
+// RABBITMQ_LOCAL_URI/RABBITMQ_REMOTE_URI scheme so existing deployments
+// don't go from two brokers to zero on upgrade.
+func publishTargetNames(logger *slog.Logger) []string {
+	raw := os.Getenv("PUBLISH_TARGETS")
+	if raw == "" {
+		return legacyTargetNames(logger)
+	}
 
-func main() {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// legacyTargetNames reconstructs the target list the old RABBITMQ_LOCAL_URI/
+// RABBITMQ_REMOTE_URI/RABBITMQ_USE_TLS/RABBITMQ_USE_MTLS env vars used to
+// describe, so upgrading a deployment without migrating its config doesn't
+// silently drop it to zero publish targets. The URI/TLS lookups for these
+// two names fall back to the legacy vars in legacyURI/legacyTLS below.
+func legacyTargetNames(logger *slog.Logger) []string {
+	var names []string
+	if os.Getenv("RABBITMQ_LOCAL_URI") != "" {
+		names = append(names, "local")
+	}
+	if os.Getenv("RABBITMQ_REMOTE_URI") != "" {
+		names = append(names, "remote")
+	}
+	if len(names) > 0 {
+		logger.Warn("PUBLISH_TARGETS not set, falling back to deprecated RABBITMQ_LOCAL_URI/RABBITMQ_REMOTE_URI env vars; migrate to PUBLISH_TARGETS and PUBLISH_TARGET_<NAME>_URI")
+	}
+	return names
+}
+
+// legacyURI falls back to the pre-PUBLISH_TARGETS env var for the "local"/
+// "remote" target names, so a deployment that hasn't migrated its config
+// still resolves a URI for the targets legacyTargetNames produced.
+func legacyURI(name string) string {
+	switch name {
+	case "local":
+		return os.Getenv("RABBITMQ_LOCAL_URI")
+	case "remote":
+		return os.Getenv("RABBITMQ_REMOTE_URI")
+	default:
+		return ""
+	}
+}
 
-	err := utils.SetupFileLogger("log/ms-temp-sensor.log")
+// legacyTLSBool falls back to the shared (non-per-target) RABBITMQ_USE_TLS/
+// RABBITMQ_USE_MTLS env vars for the "local"/"remote" target names.
+func legacyTLSBool(key string, name string, defaultVal bool) bool {
+	switch name {
+	case "local", "remote":
+		return getEnvBool(key, defaultVal)
+	default:
+		return defaultVal
+	}
+}
+
+// clientRef pairs a configured Publisher with the target name and resolved
+// config it was built from. cfg is kept so a SIGHUP reload can tell
+// whether a target's config actually changed, which decideReload uses to
+// decide between reusing the client and redialing it. inFlight is owned by this client alone, not shared across
+// targets, so draining one target's in-flight publishes can never be
+// blocked by unrelated traffic on another target.
+type clientRef struct {
+	name     string
+	cfg      targetConfig
+	client   publisher.Publisher
+	inFlight *sync.WaitGroup
+}
+
+// targetConfig is a publish target's resolved URI/TLS configuration. Two
+// targetConfigs compare equal (via ==) when the URI, the TLS flags and the
+// cert/key/CA paths are all the same, which decideReload uses to decide
+// whether a target's existing client can be reused as-is. Only the paths
+// are compared, not the files' contents: certificate files replaced in
+// place at unchanged paths leave the config equal, so a SIGHUP reload
+// keeps the existing client and its previously loaded TLS material.
+type targetConfig struct {
+	uri      string
+	useTLS   bool
+	useMTLS  bool
+	certPath string
+	keyPath  string
+	caPath   string
+}
+
+// resolveTargetConfigs reads PUBLISH_TARGETS and, for each target, its URI
+// and TLS env vars. It is the single source of truth buildClients and
+// reloadClients both build from, so a live-reload sees the same config a
+// fresh start would.
+func resolveTargetConfigs(logger *slog.Logger) map[string]targetConfig {
+	configs := make(map[string]targetConfig)
+
+	for _, name := range publishTargetNames(logger) {
+		targetLogger := logger.With("component", "publisher", "target", name)
+
+		uri := os.Getenv(fmt.Sprintf("PUBLISH_TARGET_%s_URI", strings.ToUpper(name)))
+		if uri == "" {
+			uri = legacyURI(name)
+		}
+		if uri == "" {
+			targetLogger.Warn("publish target has no URI configured, skipping")
+			continue
+		}
+
+		upper := strings.ToUpper(name)
+		configs[name] = targetConfig{
+			uri:      uri,
+			useTLS:   getEnvBool(fmt.Sprintf("PUBLISH_TARGET_%s_USE_TLS", upper), legacyTLSBool("RABBITMQ_USE_TLS", name, false)),
+			useMTLS:  getEnvBool(fmt.Sprintf("PUBLISH_TARGET_%s_USE_MTLS", upper), legacyTLSBool("RABBITMQ_USE_MTLS", name, false)),
+			certPath: os.Getenv(fmt.Sprintf("PUBLISH_TARGET_%s_TLS_CERT", upper)),
+			keyPath:  os.Getenv(fmt.Sprintf("PUBLISH_TARGET_%s_TLS_KEY", upper)),
+			caPath:   os.Getenv(fmt.Sprintf("PUBLISH_TARGET_%s_TLS_CA", upper)),
+		}
+	}
+
+	return configs
+}
+
+// dialClient dials a Publisher for a single target, logging and reporting
+// failure via ok rather than an error so callers can skip a bad target
+// without aborting the rest of the reload/startup.
+func dialClient(logger *slog.Logger, queue, name string, cfg targetConfig) (clientRef, bool) {
+	targetLogger := logger.With("component", "publisher", "target", name, "queue", queue)
+
+	tlsCfg, err := rabbitmq.LoadTLSConfig(cfg.useTLS, cfg.useMTLS, cfg.certPath, cfg.keyPath, cfg.caPath)
 	if err != nil {
-		log.Fatalf("Failed to set up log file: %v", err)
+		targetLogger.Error("TLS config error for publish target", "error", err)
+		return clientRef{}, false
 	}
 
-	hostname, _ := os.Hostname()
-	sensorPath, err := findSensorPath()
+	client, err := publisher.New(cfg.uri, queue, name, tlsCfg, targetLogger)
 	if err != nil {
-		log.Fatalf("Sensor not found: %v", err)
+		targetLogger.Error("publish target connection failed", "error", err)
+		return clientRef{}, false
 	}
 
-	localURI := os.Getenv("RABBITMQ_LOCAL_URI")
-	remoteURI := os.Getenv("RABBITMQ_REMOTE_URI")
-	queue := os.Getenv("RABBITMQ_QUEUE")
-	if queue == "" {
-		queue = "temp"
+	return clientRef{name: name, cfg: cfg, client: client, inFlight: &sync.WaitGroup{}}, true
+}
+
+// buildClients reads PUBLISH_TARGETS and dials a fresh Publisher for every
+// target. Used at startup, where there are no existing clients to reuse.
+func buildClients(logger *slog.Logger, queue string) []clientRef {
+	var clients []clientRef
+	for name, cfg := range resolveTargetConfigs(logger) {
+		if ref, ok := dialClient(logger, queue, name, cfg); ok {
+			clients = append(clients, ref)
+		}
+	}
+	return clients
+}
+
+// decideReload compares old against the freshly resolved configs and
+// splits the reload into reused (a target whose resolved config is
+// unchanged, so its existing client/spool is kept as-is), toDial (a new or
+// changed target that needs a fresh client dialed) and retired (an old
+// client that is no longer part of the reload - either its target's config
+// changed or it was dropped from PUBLISH_TARGETS - for the caller to drain
+// and close). It's pure/dial-free so the reuse-vs-redial decision - the
+// part that matters for not ending up with two rabbitmq.Client/spool.Spool
+// instances pointed at the same SPOOL_DIR/target/queue directory at once -
+// can be unit tested without a real broker.
+func decideReload(old []clientRef, configs map[string]targetConfig) (reused []clientRef, toDial map[string]targetConfig, retired []clientRef) {
+	oldByName := make(map[string]clientRef, len(old))
+	for _, c := range old {
+		oldByName[c.name] = c
+	}
+
+	keep := make(map[string]bool, len(old))
+	toDial = make(map[string]targetConfig, len(configs))
+	for name, cfg := range configs {
+		if existing, ok := oldByName[name]; ok && existing.cfg == cfg {
+			reused = append(reused, existing)
+			keep[name] = true
+			continue
+		}
+		toDial[name] = cfg
+	}
+
+	for _, c := range old {
+		if !keep[c.name] {
+			retired = append(retired, c)
+		}
+	}
+	return reused, toDial, retired
+}
+
+// reloadClients rebuilds publish targets for a SIGHUP reload, dialing a
+// fresh client for anything decideReload says changed or is new and
+// reusing the rest as-is.
+//
+// A target whose config changed (e.g. new cert paths) keeps its name and
+// its stale client is still perfectly healthy, so the redial is tried
+// before that stale client is touched at all: if it fails (a typo'd
+// cert path, the broker being transiently unreachable), the target
+// keeps running on its old connection instead of being silently dropped
+// until another manual SIGHUP, and the loss of the config update is
+// logged loudly rather than only being visible as a routine dial-failure
+// log line. Only once a replacement is dialed successfully is the stale
+// client folded into retired, the same bucket a target dropped from
+// PUBLISH_TARGETS entirely lands in, for the caller to drain and close
+// asynchronously - so a slow drain never blocks the other,
+// already-reloaded targets' publishing. Dials run one after another on
+// the calling goroutine, so a slow dial does hold up the caller until
+// reloadClients returns.
+func reloadClients(logger *slog.Logger, queue string, old []clientRef) (reloaded, retired []clientRef) {
+	reused, toDial, allRetired := decideReload(old, resolveTargetConfigs(logger))
+	reloaded = append(reloaded, reused...)
+
+	staleByName := make(map[string]clientRef, len(allRetired))
+	for _, c := range allRetired {
+		staleByName[c.name] = c
+	}
+
+	for name, cfg := range toDial {
+		ref, ok := dialClient(logger, queue, name, cfg)
+		if !ok {
+			if stale, hadStale := staleByName[name]; hadStale {
+				logger.Error("reload: redial failed for a previously-healthy target, keeping its existing connection", "target", name)
+				reloaded = append(reloaded, stale)
+				delete(staleByName, name)
+			}
+			continue
+		}
+		reloaded = append(reloaded, ref)
+	}
+
+	for _, c := range allRetired {
+		if _, ok := staleByName[c.name]; ok {
+			retired = append(retired, c)
+		}
+	}
+	return reloaded, retired
+}
+
+func closeClients(logger *slog.Logger, clients []clientRef) {
+	for _, c := range clients {
+		if err := c.client.Close(); err != nil {
+			logger.Error("failed to close publish target", "target", c.name, "error", err)
+		}
+		brokerUp.DeleteLabelValues(c.name)
+	}
+}
+
+// drainThenClose waits up to timeout for clients' own in-flight publishes to
+// finish before closing them. Each clientRef tracks its own inFlight, so
+// this only ever waits on traffic belonging to clients, never on unrelated
+// publishes against targets that aren't being closed. Used both when a
+// SIGHUP reload retires a target and at shutdown, so publishes kicked off
+// against the old/current clients get the same grace period before their
+// connections are torn out from under them.
+func drainThenClose(logger *slog.Logger, clients []clientRef, timeout time.Duration, timeoutMsg string) {
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, c := range clients {
+			wg.Add(1)
+			go func(c clientRef) {
+				defer wg.Done()
+				c.inFlight.Wait()
+			}(c)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warn(timeoutMsg, "timeout", timeout)
 	}
 
-	useMTLS := getEnvBool("RABBITMQ_USE_MTLS", false)
-	useTLS := getEnvBool("RABBITMQ_USE_TLS", false)
+	closeClients(logger, clients)
+}
+
+// recordPublishResult updates msgCount for a publish attempt against
+// target and logs it if it failed. msgCount must only count payloads the
+// broker actually acked: rabbitmq.ErrSpooled means the payload only made
+// it to the on-disk spool after the retry budget was exhausted, which can
+// still silently drop it later under retention pressure, so it's kept out
+// of msgCount but not logged as a failure here (the rabbitmq client
+// already logs the spool fallback).
+func recordPublishResult(logger *slog.Logger, target, queue string, err error) {
+	switch {
+	case err == nil:
+		msgCount.Inc()
+	case errors.Is(err, rabbitmq.ErrSpooled):
+	default:
+		logger.Error("failed to publish", "broker", target, "queue", queue, "error", err)
+	}
+}
 
-	tlsCfg, err := rabbitmq.LoadTLSConfig(useTLS, useMTLS)
+// reportBrokerHealth refreshes the broker_up gauge for every active
+// publish target.
+func reportBrokerHealth(clients []clientRef) {
+	for _, c := range clients {
+		if c.client.Healthy() {
+			brokerUp.WithLabelValues(c.name).Set(1)
+		} else {
+			brokerUp.WithLabelValues(c.name).Set(0)
+		}
+	}
+}
+
+// healthy reflects liveness: the process is running and isn't mid-shutdown.
+// It's read from the /healthz and /readyz handler goroutines and written
+// from the main loop on shutdown, so it's an atomic.Bool rather than a
+// plain bool, same as activeClients/lastSensorReadUnixNano below.
+var healthy atomic.Bool
+
+// lastSensorReadUnixNano is updated after every successful sensor read and
+// backs the /readyz staleness check.
+var lastSensorReadUnixNano atomic.Int64
+
+// anyClientHealthy reports whether at least one of clients has a usable
+// broker connection.
+func anyClientHealthy(clients []clientRef) bool {
+	for _, c := range clients {
+		if c.client.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// isReady reports readiness: at least one broker is publishable and the
+// sensor produced a valid reading within maxStaleness of now.
+func isReady(clients []clientRef, lastSensorReadUnixNano int64, maxStaleness time.Duration, now time.Time) bool {
+	sensorFresh := now.Sub(time.Unix(0, lastSensorReadUnixNano)) <= maxStaleness
+	return anyClientHealthy(clients) && sensorFresh
+}
+
+// readyzHandler serves /readyz: liveness must hold, and isReady must hold,
+// for the probe to report OK.
+func readyzHandler(activeClients *atomic.Pointer[[]clientRef], readyMaxStaleness time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if isReady(*activeClients.Load(), lastSensorReadUnixNano.Load(), readyMaxStaleness, time.Now()) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func main() {
+	logger, err := utils.NewLogger("log/ms-temp-sensor.log")
 	if err != nil {
-		log.Fatalf("TLS config error: %v", err)
+		fmt.Fprintf(os.Stderr, "failed to set up log file: %v\n", err)
+		os.Exit(1)
 	}
 
-	type clientRef struct {
-		name   string
-		client *rabbitmq.Client
+	hostname, _ := os.Hostname()
+	logger = logger.With("hostname", hostname)
+
+	sensorPath, err := findSensorPath()
+	if err != nil {
+		logger.Error("sensor not found", "error", err)
+		os.Exit(1)
 	}
 
-	var clients []clientRef
+	healthy.Store(true)
+
+	queue := os.Getenv("RABBITMQ_QUEUE")
+	if queue == "" {
+		queue = "temp"
+	}
+
+	shutdownTimeout := 10 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil {
+			shutdownTimeout = parsed
+		} else {
+			logger.Warn("invalid SHUTDOWN_TIMEOUT, using default", "value", v, "default", shutdownTimeout)
+		}
+	}
 
-	if localURI != "" {
-		client, err := rabbitmq.NewClient(localURI, queue, tlsCfg)
-		if err != nil {
-			log.Printf("Local RabbitMQ connection failed: %v", err)
+	readyMaxStaleness := 60 * time.Second
+	if v := os.Getenv("READY_MAX_STALENESS"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil {
+			readyMaxStaleness = parsed
 		} else {
-			clients = append(clients, clientRef{"local", client})
+			logger.Warn("invalid READY_MAX_STALENESS, using default", "value", v, "default", readyMaxStaleness)
 		}
 	}
 
-	if remoteURI != "" {
-		client, err := rabbitmq.NewClient(remoteURI, queue, tlsCfg)
-		if err != nil {
-			log.Printf("Remote RabbitMQ connection failed: %v", err)
+	// publishTimeout bounds a single tick's publish, including the full
+	// reconnectWithBackoff retry budget (PUBLISH_MAX_ATTEMPTS, exponential
+	// backoff with jitter - worst case ~46.5s at the defaults of 5
+	// attempts starting at 1s), so it's deliberately independent of
+	// shutdownTimeout: reusing the (much shorter) shutdown grace period
+	// here cut the retry budget off partway through and dropped payloads
+	// on the floor before they ever reached the spool.
+	publishTimeout := 60 * time.Second
+	if v := os.Getenv("PUBLISH_TIMEOUT"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil {
+			publishTimeout = parsed
 		} else {
-			clients = append(clients, clientRef{"remote", client})
+			logger.Warn("invalid PUBLISH_TIMEOUT, using default", "value", v, "default", publishTimeout)
 		}
 	}
 
-	if len(clients) == 0 {
-		log.Fatal("No RabbitMQ connections available")
+	initialClients := buildClients(logger, queue)
+	if len(initialClients) == 0 {
+		logger.Error("no publish targets available")
+		os.Exit(1)
 	}
 
+	var activeClients atomic.Pointer[[]clientRef]
+	activeClients.Store(&initialClients)
+
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
 		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-			if healthy {
+			// Liveness: the process is running and isn't mid-shutdown.
+			if healthy.Load() {
 				w.WriteHeader(http.StatusOK)
 				w.Write([]byte("OK"))
 			} else {
 				w.WriteHeader(http.StatusInternalServerError)
 			}
 		})
-		log.Println("Serving /metrics and /healthz on :8080")
-		log.Fatal(http.ListenAndServe(":8080", nil))
+		http.HandleFunc("/readyz", readyzHandler(&activeClients, readyMaxStaleness))
+		logger.Info("serving /metrics, /healthz, and /readyz", "addr", ":8080")
+		if err := http.ListenAndServe(":8080", nil); err != nil {
+			logger.Error("http server failed", "error", err)
+			os.Exit(1)
+		}
 	}()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	shutdownChan := make(chan os.Signal, 1)
+	signal.Notify(shutdownChan, syscall.SIGINT, syscall.SIGTERM)
+
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
 
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -169,9 +553,12 @@ func main() {
 	for {
 		select {
 		case <-ticker.C:
+			clients := *activeClients.Load()
+			reportBrokerHealth(clients)
+
 			temp, err := readTemperature(sensorPath)
 			if err != nil {
-				log.Printf("Failed to read sensor: %v", err)
+				logger.Error("failed to read sensor", "error", err)
 				continue
 			}
 			msg := TemperatureMessage{
@@ -181,19 +568,45 @@ func main() {
 			}
 
 			tempGauge.Set(temp)
-			msgCount.Inc()
+			lastSensorReadUnixNano.Store(time.Now().UnixNano())
+			logger.Debug("read sensor", "temp_c", temp)
 
 			for _, c := range clients {
-				if err := c.client.PublishJSON(msg); err != nil {
-					log.Printf("Failed to publish to %s: %v", c.name, err)
-				}
+				c.inFlight.Add(1)
+				go func(c clientRef) {
+					defer c.inFlight.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+					defer cancel()
+					recordPublishResult(logger, c.name, queue, c.client.Publish(ctx, queue, msg))
+				}(c)
 			}
-		case <-sigChan:
-			log.Println("Shutting down")
-			healthy = false
-			for _, c := range clients {
-				c.client.Close()
+		case <-reloadChan:
+			logger.Info("reloading publish targets (SIGHUP)")
+			old := *activeClients.Load()
+			reloaded, retired := reloadClients(logger, queue, old)
+			if len(reloaded) == 0 {
+				logger.Warn("reload produced no usable publish targets, keeping existing ones")
+				continue
 			}
+			activeClients.Store(&reloaded)
+
+			if len(retired) > 0 {
+				// A target here either dropped out of PUBLISH_TARGETS
+				// entirely, or changed config and was successfully
+				// redialed - reloadClients only retires a changed
+				// target's stale client once its replacement is already
+				// dialed and in reloaded. Publishes kicked off against
+				// the retired client on a prior tick may still be in
+				// flight; give them the same chance to drain that a
+				// shutdown does before tearing the connection down.
+				go drainThenClose(logger, retired, shutdownTimeout, "timed out waiting for in-flight publishes before closing retired targets")
+			}
+		case <-shutdownChan:
+			logger.Info("shutting down")
+			healthy.Store(false)
+			ticker.Stop()
+
+			drainThenClose(logger, *activeClients.Load(), shutdownTimeout, "timed out waiting for in-flight publishes")
 			return
 		}
 	}
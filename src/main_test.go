@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go-temp/rabbitmq"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// fakePublisher is a minimal publisher.Publisher double for exercising
+// main's client-lifecycle helpers without dialing a real broker.
+type fakePublisher struct {
+	healthy bool
+	closed  atomicBool
+}
+
+type atomicBool struct {
+	mu sync.Mutex
+	v  bool
+}
+
+func (a *atomicBool) set(v bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.v = v
+}
+
+func (a *atomicBool) get() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.v
+}
+
+func (p *fakePublisher) Publish(context.Context, string, any) error { return nil }
+func (p *fakePublisher) Close() error                               { p.closed.set(true); return nil }
+func (p *fakePublisher) Healthy() bool                              { return p.healthy }
+
+func TestDrainThenCloseWaitsForInFlight(t *testing.T) {
+	fp := &fakePublisher{healthy: true}
+	var inFlight sync.WaitGroup
+	clients := []clientRef{{name: "local", client: fp, inFlight: &inFlight}}
+
+	inFlight.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		drainThenClose(discardLogger(), clients, time.Second, "unexpected timeout")
+		close(done)
+	}()
+
+	// drainThenClose should still be waiting on inFlight.
+	select {
+	case <-done:
+		t.Fatal("drainThenClose returned before inFlight.Done was called")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if fp.closed.get() {
+		t.Fatal("client closed before inFlight drained")
+	}
+
+	inFlight.Done()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drainThenClose did not return after inFlight drained")
+	}
+	if !fp.closed.get() {
+		t.Fatal("client not closed after inFlight drained")
+	}
+}
+
+// TestDrainThenCloseIgnoresUnrelatedInFlight asserts that drainThenClose only
+// waits on the inFlight of the clients it was handed, not on unrelated
+// traffic against other targets - each clientRef owns its own WaitGroup
+// precisely so that a busy reused/new target can never stall closing a
+// retired one.
+func TestDrainThenCloseIgnoresUnrelatedInFlight(t *testing.T) {
+	retiredFP := &fakePublisher{healthy: true}
+	retired := clientRef{name: "retired", client: retiredFP, inFlight: &sync.WaitGroup{}}
+
+	var unrelatedInFlight sync.WaitGroup
+	unrelatedInFlight.Add(1)
+	defer unrelatedInFlight.Done()
+
+	done := make(chan struct{})
+	go func() {
+		drainThenClose(discardLogger(), []clientRef{retired}, time.Second, "unexpected timeout")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drainThenClose waited on an unrelated target's in-flight publishes")
+	}
+	if !retiredFP.closed.get() {
+		t.Fatal("retired client not closed")
+	}
+}
+
+func TestRecordPublishResultOnlyCountsBrokerAck(t *testing.T) {
+	before := testutil.ToFloat64(msgCount)
+
+	recordPublishResult(discardLogger(), "local", "temp", nil)
+	if got := testutil.ToFloat64(msgCount); got != before+1 {
+		t.Errorf("msgCount after a broker ack = %v, want %v", got, before+1)
+	}
+
+	recordPublishResult(discardLogger(), "local", "temp", rabbitmq.ErrSpooled)
+	if got := testutil.ToFloat64(msgCount); got != before+1 {
+		t.Errorf("msgCount after a spool fallback = %v, want unchanged at %v: spooled payloads aren't delivered yet", got, before+1)
+	}
+
+	recordPublishResult(discardLogger(), "local", "temp", errors.New("boom"))
+	if got := testutil.ToFloat64(msgCount); got != before+1 {
+		t.Errorf("msgCount after a publish failure = %v, want unchanged at %v", got, before+1)
+	}
+}
+
+func TestReportBrokerHealth(t *testing.T) {
+	up := &fakePublisher{healthy: true}
+	down := &fakePublisher{healthy: false}
+	clients := []clientRef{{name: "up-target", client: up}, {name: "down-target", client: down}}
+
+	reportBrokerHealth(clients)
+
+	if got := testutil.ToFloat64(brokerUp.WithLabelValues("up-target")); got != 1 {
+		t.Errorf("broker_up{target=up-target} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(brokerUp.WithLabelValues("down-target")); got != 0 {
+		t.Errorf("broker_up{target=down-target} = %v, want 0", got)
+	}
+}
+
+func TestIsReady(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	fresh := now.Add(-5 * time.Second).UnixNano()
+	stale := now.Add(-5 * time.Minute).UnixNano()
+	up := []clientRef{{name: "local", client: &fakePublisher{healthy: true}}}
+	down := []clientRef{{name: "local", client: &fakePublisher{healthy: false}}}
+
+	cases := []struct {
+		name     string
+		clients  []clientRef
+		lastRead int64
+		want     bool
+	}{
+		{"broker up and sensor fresh", up, fresh, true},
+		{"broker down", down, fresh, false},
+		{"sensor stale", up, stale, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isReady(tc.clients, tc.lastRead, time.Minute, now); got != tc.want {
+				t.Errorf("isReady() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	origHealthy := healthy.Load()
+	t.Cleanup(func() { healthy.Store(origHealthy) })
+
+	var activeClients atomic.Pointer[[]clientRef]
+	clients := []clientRef{{name: "local", client: &fakePublisher{healthy: true}}}
+	activeClients.Store(&clients)
+	lastSensorReadUnixNano.Store(time.Now().UnixNano())
+
+	healthy.Store(true)
+	handler := readyzHandler(&activeClients, time.Minute)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 200 {
+		t.Errorf("status = %d, want 200 when healthy, broker up, sensor fresh", rec.Code)
+	}
+
+	healthy.Store(false)
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Errorf("status = %d, want 503 when not live", rec.Code)
+	}
+	healthy.Store(true)
+
+	down := []clientRef{{name: "local", client: &fakePublisher{healthy: false}}}
+	activeClients.Store(&down)
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Errorf("status = %d, want 503 when every broker is down", rec.Code)
+	}
+}
+
+func TestDrainThenCloseTimesOut(t *testing.T) {
+	fp := &fakePublisher{healthy: true}
+	var inFlight sync.WaitGroup
+	clients := []clientRef{{name: "local", client: fp, inFlight: &inFlight}}
+
+	inFlight.Add(1) // never Done(), forcing the timeout path
+	defer inFlight.Done()
+
+	done := make(chan struct{})
+	go func() {
+		drainThenClose(discardLogger(), clients, 10*time.Millisecond, "timed out waiting for in-flight publishes")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drainThenClose did not time out")
+	}
+	if !fp.closed.get() {
+		t.Fatal("client not closed after timeout")
+	}
+}
+
+func TestPublishTargetNamesFromEnv(t *testing.T) {
+	t.Setenv("PUBLISH_TARGETS", " local , remote ,,nats1")
+	t.Setenv("RABBITMQ_LOCAL_URI", "amqp://should-be-ignored")
+
+	got := publishTargetNames(discardLogger())
+	want := []string{"local", "remote", "nats1"}
+	if len(got) != len(want) {
+		t.Fatalf("publishTargetNames() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("publishTargetNames()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPublishTargetNamesFallsBackToLegacy(t *testing.T) {
+	t.Setenv("PUBLISH_TARGETS", "")
+	t.Setenv("RABBITMQ_LOCAL_URI", "amqp://local")
+	t.Setenv("RABBITMQ_REMOTE_URI", "amqp://remote")
+
+	got := publishTargetNames(discardLogger())
+	want := []string{"local", "remote"}
+	if len(got) != len(want) {
+		t.Fatalf("publishTargetNames() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("publishTargetNames()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPublishTargetNamesEmptyWhenNothingConfigured(t *testing.T) {
+	t.Setenv("PUBLISH_TARGETS", "")
+	t.Setenv("RABBITMQ_LOCAL_URI", "")
+	t.Setenv("RABBITMQ_REMOTE_URI", "")
+
+	if got := publishTargetNames(discardLogger()); len(got) != 0 {
+		t.Fatalf("publishTargetNames() = %v, want empty", got)
+	}
+}
+
+func TestLegacyURI(t *testing.T) {
+	t.Setenv("RABBITMQ_LOCAL_URI", "amqp://local")
+	t.Setenv("RABBITMQ_REMOTE_URI", "amqp://remote")
+
+	if got := legacyURI("local"); got != "amqp://local" {
+		t.Errorf("legacyURI(local) = %q, want amqp://local", got)
+	}
+	if got := legacyURI("remote"); got != "amqp://remote" {
+		t.Errorf("legacyURI(remote) = %q, want amqp://remote", got)
+	}
+	if got := legacyURI("nats1"); got != "" {
+		t.Errorf("legacyURI(nats1) = %q, want empty", got)
+	}
+}
+
+func TestDecideReloadReusesUnchangedTarget(t *testing.T) {
+	existing := clientRef{name: "local", cfg: targetConfig{uri: "amqp://local"}, client: &fakePublisher{healthy: true}}
+	old := []clientRef{existing}
+	configs := map[string]targetConfig{"local": {uri: "amqp://local"}}
+
+	reused, toDial, retired := decideReload(old, configs)
+
+	if len(reused) != 1 || reused[0].client != existing.client {
+		t.Fatalf("decideReload() reused = %v, want the same clientRef (same client pointer) reused", reused)
+	}
+	if len(toDial) != 0 {
+		t.Errorf("decideReload() toDial = %v, want empty for an unchanged target", toDial)
+	}
+	if len(retired) != 0 {
+		t.Errorf("decideReload() retired = %v, want empty for an unchanged target", retired)
+	}
+}
+
+func TestDecideReloadRedialsChangedTarget(t *testing.T) {
+	existing := clientRef{name: "local", cfg: targetConfig{uri: "amqp://old"}, client: &fakePublisher{healthy: true}}
+	old := []clientRef{existing}
+	configs := map[string]targetConfig{"local": {uri: "amqp://new"}}
+
+	reused, toDial, retired := decideReload(old, configs)
+
+	if len(reused) != 0 {
+		t.Errorf("decideReload() reused = %v, want empty for a changed target", reused)
+	}
+	if cfg, ok := toDial["local"]; !ok || cfg.uri != "amqp://new" {
+		t.Fatalf("decideReload() toDial = %v, want local with the new config", toDial)
+	}
+	if len(retired) != 1 || retired[0].client != existing.client {
+		t.Fatalf("decideReload() retired = %v, want the old clientRef retired for draining", retired)
+	}
+}
+
+func TestDecideReloadRetiresDroppedTarget(t *testing.T) {
+	existing := clientRef{name: "local", cfg: targetConfig{uri: "amqp://local"}, client: &fakePublisher{healthy: true}}
+	old := []clientRef{existing}
+	configs := map[string]targetConfig{} // target removed from PUBLISH_TARGETS
+
+	reused, toDial, retired := decideReload(old, configs)
+
+	if len(reused) != 0 || len(toDial) != 0 {
+		t.Fatalf("decideReload() reused = %v, toDial = %v, want both empty for a dropped target", reused, toDial)
+	}
+	if len(retired) != 1 || retired[0].client != existing.client {
+		t.Fatalf("decideReload() retired = %v, want the dropped target's clientRef retired", retired)
+	}
+}
+
+// TestReloadClientsKeepsStaleClientWhenRedialFails guards against a changed
+// target being silently dropped forever when its redial fails (a typo'd
+// cert path, a transiently unreachable broker, anything): the
+// previously-healthy stale client must stay in reloaded and must not be
+// closed or handed off to the caller as retired, so the target keeps
+// publishing on its old connection until a later successful reload.
+func TestReloadClientsKeepsStaleClientWhenRedialFails(t *testing.T) {
+	t.Setenv("PUBLISH_TARGETS", "local")
+	t.Setenv("PUBLISH_TARGET_LOCAL_URI", "not-a-valid-uri")
+
+	stale := &fakePublisher{healthy: true}
+	old := []clientRef{{name: "local", cfg: targetConfig{uri: "amqp://old"}, client: stale, inFlight: &sync.WaitGroup{}}}
+
+	reloaded, retired := reloadClients(discardLogger(), "queue", old)
+
+	if len(reloaded) != 1 || reloaded[0].client != stale {
+		t.Fatalf("reloadClients() reloaded = %v, want the stale client kept in place since its redial failed", reloaded)
+	}
+	if len(retired) != 0 {
+		t.Errorf("reloadClients() retired = %v, want empty: a target whose redial failed must not be retired", retired)
+	}
+	if stale.closed.get() {
+		t.Error("stale client was closed even though its redial failed; target would be lost until another manual SIGHUP")
+	}
+}
+
+func TestDecideReloadDialsNewTarget(t *testing.T) {
+	configs := map[string]targetConfig{"nats1": {uri: "nats://new"}}
+
+	reused, toDial, retired := decideReload(nil, configs)
+
+	if len(reused) != 0 || len(retired) != 0 {
+		t.Fatalf("decideReload() reused = %v, retired = %v, want both empty for a brand-new target", reused, retired)
+	}
+	if cfg, ok := toDial["nats1"]; !ok || cfg.uri != "nats://new" {
+		t.Fatalf("decideReload() toDial = %v, want nats1 with its config", toDial)
+	}
+}
+
+func TestLegacyTLSBool(t *testing.T) {
+	t.Setenv("RABBITMQ_USE_TLS", "true")
+
+	if got := legacyTLSBool("RABBITMQ_USE_TLS", "local", false); got != true {
+		t.Errorf("legacyTLSBool(local) = %v, want true", got)
+	}
+	if got := legacyTLSBool("RABBITMQ_USE_TLS", "nats1", false); got != false {
+		t.Errorf("legacyTLSBool(nats1) = %v, want default false (not a legacy target name)", got)
+	}
+}
@@ -0,0 +1,69 @@
+package publisher
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublisher publishes JSON payloads to an MQTT topic.
+type mqttPublisher struct {
+	client mqtt.Client
+	topic  string
+	logger *slog.Logger
+}
+
+func newMQTTPublisher(uri, topic, target string, tlsCfg *tls.Config, logger *slog.Logger) (Publisher, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(uri).
+		SetClientID(fmt.Sprintf("go-temp-sensor-%s", target)).
+		SetAutoReconnect(true)
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, fmt.Errorf("mqtt connect failed: timed out after 10s")
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("mqtt connect failed: %w", err)
+	}
+
+	logger.Info("connected to MQTT broker", "broker", "mqtt")
+	return &mqttPublisher{client: client, topic: topic, logger: logger}, nil
+}
+
+func (p *mqttPublisher) Publish(ctx context.Context, topic string, payload any) error {
+	if topic == "" {
+		topic = p.topic
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	token := p.client.Publish(topic, 1, false, body)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *mqttPublisher) Close() error {
+	p.client.Disconnect(250)
+	return nil
+}
+
+func (p *mqttPublisher) Healthy() bool {
+	return p.client.IsConnected()
+}
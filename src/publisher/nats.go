@@ -0,0 +1,81 @@
+package publisher
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsPublisher publishes JSON payloads to a NATS subject.
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+	logger  *slog.Logger
+}
+
+func newNATSPublisher(uri, subject string, tlsCfg *tls.Config, logger *slog.Logger) (Publisher, error) {
+	opts := []nats.Option{nats.Name("go-temp")}
+	if tlsCfg != nil {
+		opts = append(opts, nats.Secure(tlsCfg))
+	}
+
+	conn, err := nats.Connect(uri, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("nats connect failed: %w", err)
+	}
+
+	logger.Info("connected to NATS", "broker", "nats")
+	return &natsPublisher{conn: conn, subject: subject, logger: logger}, nil
+}
+
+// Publish buffers payload for delivery, then flushes the connection so the
+// call doesn't return until the broker has round-tripped a PONG for it -
+// otherwise ctx (the PUBLISH_TIMEOUT-bound deadline threaded through
+// Publisher.Publish) would have nothing to bound, since nats.Conn.Publish
+// itself only writes to a local buffer.
+func (p *natsPublisher) Publish(ctx context.Context, topic string, payload any) error {
+	if topic == "" {
+		topic = p.subject
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if err := p.conn.Publish(topic, body); err != nil {
+		return err
+	}
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- p.conn.Flush() }()
+
+	select {
+	case err := <-flushed:
+		return err
+	case <-ctx.Done():
+		// Publish is returning ctx.Err() to its caller, but the flush
+		// it kicked off is still running against the broker - log its
+		// eventual outcome instead of letting it vanish once nobody is
+		// left reading flushed.
+		go func() {
+			if err := <-flushed; err != nil {
+				p.logger.Warn("nats flush failed after publish timed out", "error", err)
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+func (p *natsPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
+
+func (p *natsPublisher) Healthy() bool {
+	return p.conn.IsConnected()
+}
@@ -0,0 +1,55 @@
+// Package publisher provides a broker-agnostic fan-out abstraction so the
+// sensor can publish readings to heterogeneous message brokers (RabbitMQ,
+// NATS, MQTT, ...) without the caller needing to know which one it's
+// talking to.
+package publisher
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/url"
+)
+
+// Publisher is implemented by every supported broker backend.
+type Publisher interface {
+	// Publish sends payload (marshaled as JSON) to topic. For backends
+	// that are bound to a single destination at construction time (e.g.
+	// a RabbitMQ queue), topic may be ignored.
+	Publish(ctx context.Context, topic string, payload any) error
+	// Close releases any underlying connections.
+	Close() error
+	// Healthy reports whether the backend's connection to its broker is
+	// currently usable.
+	Healthy() bool
+}
+
+// New dials a Publisher for uri, whose scheme selects the backend:
+//
+//	amqp://, amqps://  -> RabbitMQ
+//	nats://             -> NATS
+//	mqtt://, tcp://, ssl://, tls://  -> MQTT
+//
+// queue is used as the default topic/routing key/queue name for backends
+// that need one configured up front. target is the configured publish
+// target name (e.g. "local", "remote") and is used to scope any on-disk
+// state a backend keeps per target. logger receives the backend's
+// connection and publish-failure diagnostics.
+func New(uri, queue, target string, tlsCfg *tls.Config, logger *slog.Logger) (Publisher, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publish target uri %q: %w", uri, err)
+	}
+
+	switch u.Scheme {
+	case "amqp", "amqps":
+		return newRabbitMQPublisher(uri, queue, target, tlsCfg, logger)
+	case "nats":
+		return newNATSPublisher(uri, queue, tlsCfg, logger)
+	case "mqtt", "tcp", "ssl", "tls":
+		return newMQTTPublisher(uri, queue, target, tlsCfg, logger)
+	default:
+		return nil, fmt.Errorf("unsupported publish target scheme %q in %q", u.Scheme, uri)
+	}
+}
@@ -0,0 +1,37 @@
+package publisher
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+
+	"go-temp/rabbitmq"
+)
+
+// rabbitMQPublisher adapts rabbitmq.Client to the Publisher interface.
+type rabbitMQPublisher struct {
+	client *rabbitmq.Client
+}
+
+func newRabbitMQPublisher(uri, queue, target string, tlsCfg *tls.Config, logger *slog.Logger) (Publisher, error) {
+	client, err := rabbitmq.NewClient(uri, queue, target, tlsCfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &rabbitMQPublisher{client: client}, nil
+}
+
+// Publish forwards payload to the client's configured queue. topic is
+// ignored: a RabbitMQ client is bound to a single queue at construction.
+func (p *rabbitMQPublisher) Publish(ctx context.Context, _ string, payload any) error {
+	return p.client.PublishJSON(ctx, payload)
+}
+
+func (p *rabbitMQPublisher) Close() error {
+	p.client.Close()
+	return nil
+}
+
+func (p *rabbitMQPublisher) Healthy() bool {
+	return p.client.Healthy()
+}
@@ -1,33 +1,199 @@
 package rabbitmq
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	amqp "github.com/rabbitmq/amqp091-go"
+
+	"go-temp/spool"
+)
+
+// drainInterval is how often a client with a non-empty spool retries
+// flushing it to the broker.
+const drainInterval = 5 * time.Second
+
+// defaultConfirmWindow bounds how many publishes can be awaiting broker
+// confirmation at once.
+const defaultConfirmWindow = 32
+
+// defaultMaxAttempts is the retry budget for reconnect-and-republish
+// before a payload falls back to the spool.
+const defaultMaxAttempts = 5
+
+// ErrSpooled is returned by PublishJSON when the broker never acked the
+// payload and it was instead written to the on-disk spool for later
+// delivery. Callers that count delivered messages must treat it
+// distinctly from a nil error: the spool can still silently drop the
+// payload under retention pressure (spool_drops_total), so counting it
+// as published here would overcount actual deliveries.
+var ErrSpooled = errors.New("payload spooled to disk, not delivered to broker")
+
+var (
+	publishNacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "publish_nacks_total",
+		Help: "Total number of publishes the broker explicitly nacked, by queue",
+	}, []string{"queue"})
+
+	publishConfirmLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "publish_confirm_latency_seconds",
+		Help:    "Time from publish to broker confirmation, by queue",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"queue"})
+
+	spoolBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spool_bytes",
+		Help: "Total size in bytes of unpublished samples spooled to disk, by queue",
+	}, []string{"queue"})
+
+	spoolRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spool_records",
+		Help: "Number of unpublished samples spooled to disk, by queue",
+	}, []string{"queue"})
+
+	spoolDropsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spool_drops_total",
+		Help: "Total number of spooled samples discarded because retention limits were exceeded, by queue",
+	}, []string{"queue"})
 )
 
+func init() {
+	prometheus.MustRegister(publishNacksTotal, publishConfirmLatency, spoolBytes, spoolRecords, spoolDropsTotal)
+}
+
 type Client struct {
+	// connMu guards conn/channel, which connect() swaps out from under a
+	// publish that's mid-retry whenever reconnectWithBackoff fires
+	// concurrently with drainLoop's own use of the same client.
+	connMu  sync.RWMutex
 	conn    *amqp.Connection
 	channel *amqp.Channel
 	queue   string
 	uri     string
 	tlsCfg  *tls.Config
+	logger  *slog.Logger
+
+	confirmSem  chan struct{}
+	maxAttempts int
+
+	spool     *spool.Spool
+	drainStop chan struct{}
+	drainWG   sync.WaitGroup
+	lastDrops atomic.Uint64
+
+	// closed tracks broker liveness: it is cleared on connect and on
+	// every successful publish confirmation, and set by the
+	// connection's NotifyClose callback, so Healthy reflects the
+	// broker's real state rather than just whether Close was called.
+	closed atomic.Bool
 }
 
-func NewClient(uri, queue string, tlsCfg *tls.Config) (*Client, error) {
-	client := &Client{uri: uri, queue: queue, tlsCfg: tlsCfg}
+// NewClient dials uri and declares queue. target names this client's
+// publish target (e.g. "local", "remote") and scopes its spool directory
+// so two clients pointed at the same queue don't share one on-disk spool.
+// logger receives connection, reconnect, and spool diagnostics tagged with
+// the queue name.
+func NewClient(uri, queue, target string, tlsCfg *tls.Config, logger *slog.Logger) (*Client, error) {
+	client := &Client{
+		uri:         uri,
+		queue:       queue,
+		tlsCfg:      tlsCfg,
+		logger:      logger,
+		confirmSem:  make(chan struct{}, envInt("PUBLISH_CONFIRM_WINDOW", defaultConfirmWindow)),
+		maxAttempts: envInt("PUBLISH_MAX_ATTEMPTS", defaultMaxAttempts),
+	}
 	if err := client.connect(); err != nil {
 		return nil, err
 	}
+
+	s, err := spool.Open(spool.Config{
+		Dir:             filepath.Join(envOr("SPOOL_DIR", "spool"), target, queue),
+		MaxSegmentBytes: 16 << 20,
+		MaxFiles:        envInt("SPOOL_MAX_FILES", 8),
+		MaxBytes:        envInt64("SPOOL_MAX_BYTES", 128<<20),
+		Fsync:           envBool("SPOOL_FSYNC", false),
+	})
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("spool open failed: %w", err)
+	}
+	client.spool = s
+	client.drainStop = make(chan struct{})
+
+	client.drainWG.Add(1)
+	go client.drainLoop()
+
 	return client, nil
 }
 
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+func envInt64(key string, def int64) int64 {
+	if v, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil {
+		return v
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// drainLoop periodically attempts to flush any spooled payloads to the
+// broker. Failures are expected whenever the broker is still down and are
+// silently retried on the next tick.
+func (c *Client) drainLoop() {
+	defer c.drainWG.Done()
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.drainStop:
+			return
+		case <-ticker.C:
+			if c.spool.Records() == 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), drainInterval)
+			if err := c.spool.Drain(ctx, c.publishConfirmed); err != nil {
+				c.logger.Debug("spool drain paused, broker still unavailable", "error", err)
+			}
+			cancel()
+			c.reportSpoolMetrics()
+		}
+	}
+}
+
 func (c *Client) connect() error {
 	var conn *amqp.Connection
 	var err error
@@ -46,6 +212,10 @@ func (c *Client) connect() error {
 		return fmt.Errorf("channel failed: %w", err)
 	}
 
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("confirm mode failed: %w", err)
+	}
+
 	_, err = ch.QueueDeclare(
 		c.queue, true, false, false, false, nil,
 	)
@@ -53,66 +223,221 @@ func (c *Client) connect() error {
 		return fmt.Errorf("queue declare failed: %w", err)
 	}
 
+	c.connMu.Lock()
 	c.conn = conn
 	c.channel = ch
+	c.connMu.Unlock()
+	c.closed.Store(false)
+
+	closeChan := make(chan *amqp.Error, 1)
+	conn.NotifyClose(closeChan)
+	go func() {
+		<-closeChan
+		c.closed.Store(true)
+	}()
+
 	return nil
 }
 
-func (c *Client) PublishJSON(payload any) error {
+// Healthy reports whether the broker connection is currently usable.
+func (c *Client) Healthy() bool {
+	return !c.closed.Load()
+}
+
+// PublishJSON marshals payload and publishes it to the client's queue.
+// ctx bounds the whole operation, including any reconnect-with-backoff
+// retries, so a caller can give up on a slow broker during shutdown. A
+// nil return means the broker acked the payload; ErrSpooled means it was
+// written to disk instead after the retry budget was exhausted, and a
+// caller counting delivered messages must not treat the two the same.
+func (c *Client) PublishJSON(ctx context.Context, payload any) error {
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
+	return c.publishBody(ctx, body)
+}
+
+// publishConfirmed publishes body and blocks until the broker acks, nacks,
+// or ctx is done, bounded by confirmSem so only a limited number of
+// publishes can be awaiting confirmation at once.
+func (c *Client) publishConfirmed(ctx context.Context, body []byte) error {
+	if err := c.acquireConfirmSlot(ctx); err != nil {
+		return err
+	}
 
-	err = c.channel.Publish("", c.queue, false, false, amqp.Publishing{
+	c.connMu.RLock()
+	ch := c.channel
+	c.connMu.RUnlock()
+
+	start := time.Now()
+	confirmation, err := ch.PublishWithDeferredConfirm("", c.queue, false, false, amqp.Publishing{
 		ContentType: "application/json",
 		Body:        body,
 	})
-	if err != nil && errors.Is(err, amqp.ErrClosed) {
+	if err != nil {
+		c.releaseConfirmSlot()
+		return err
+	}
+
+	ok, err := confirmation.WaitContext(ctx)
+	c.releaseConfirmSlot()
+	if err != nil {
+		return err
+	}
+
+	publishConfirmLatency.WithLabelValues(c.queue).Observe(time.Since(start).Seconds())
+	c.closed.Store(false)
+	if !ok {
+		publishNacksTotal.WithLabelValues(c.queue).Inc()
+		return fmt.Errorf("publish nacked by broker")
+	}
+	return nil
+}
+
+func (c *Client) acquireConfirmSlot(ctx context.Context) error {
+	select {
+	case c.confirmSem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) releaseConfirmSlot() {
+	<-c.confirmSem
+}
+
+func (c *Client) publishBody(ctx context.Context, body []byte) error {
+	err := c.publishConfirmed(ctx, body)
+	if err != nil && shouldReconnect(err, c.Healthy()) {
 		// try to reconnect with backoff
-		return c.reconnectWithBackoff(payload)
+		return c.reconnectWithBackoff(ctx, body)
 	}
 	return err
 }
 
-func (c *Client) reconnectWithBackoff(payload any) error {
+// shouldReconnect reports whether a failed publish should be retried via
+// reconnectWithBackoff rather than returned to the caller as-is. A failed
+// publish call itself surfaces amqp.ErrClosed, but a failed confirmation
+// (confirmation.WaitContext erroring out because the connection died while
+// the publish was awaiting its ack) does not get wrapped in ErrClosed, so
+// that path is only caught by checking healthy. ctx cancellation/deadline
+// is the caller giving up, not the broker going away, so it's excluded.
+func shouldReconnect(err error, healthy bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return !healthy || errors.Is(err, amqp.ErrClosed)
+}
+
+// reconnectWithBackoff retries connect/publish with exponential backoff
+// and jitter, up to maxAttempts. If the broker is still unreachable once
+// the retry budget is exhausted, the payload is handed off to the
+// on-disk spool instead of being dropped (returning ErrSpooled rather
+// than nil, since the broker never acked it), and a background
+// drainLoop publishes it once the broker comes back.
+func (c *Client) reconnectWithBackoff(ctx context.Context, body []byte) error {
 	backoff := time.Second
-	for i := 0; i < 5; i++ {
-		time.Sleep(backoff)
+	for i := 0; i < c.maxAttempts; i++ {
+		jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff + jitter):
+		}
 		err := c.connect()
 		if err == nil {
-			return c.PublishJSON(payload) // retry once connected
+			c.logger.Info("reconnected to RabbitMQ", "attempt", i+1)
+			return c.publishBody(ctx, body) // retry once connected
 		}
+		c.logger.Warn("reconnect attempt failed", "attempt", i+1, "error", err)
 		backoff *= 2
 	}
+
+	if c.spool != nil {
+		err := c.spool.Append(body)
+		c.reportSpoolMetrics()
+		if err != nil {
+			c.logger.Error("spool write failed after exhausting reconnect attempts", "attempts", c.maxAttempts, "error", err)
+			return fmt.Errorf("unable to reconnect to RabbitMQ and spool write failed: %w", err)
+		}
+		c.logger.Warn("broker unreachable, spooled payload to disk", "attempts", c.maxAttempts)
+		return ErrSpooled
+	}
 	return fmt.Errorf("unable to reconnect to RabbitMQ")
 }
 
+// reportSpoolMetrics refreshes the spool_bytes/spool_records gauges and
+// the spool_drops_total counter for this client's queue.
+func (c *Client) reportSpoolMetrics() {
+	spoolBytes.WithLabelValues(c.queue).Set(float64(c.spool.Bytes()))
+	spoolRecords.WithLabelValues(c.queue).Set(float64(c.spool.Records()))
+
+	total := c.spool.Drops()
+	if prev := c.lastDrops.Swap(total); total > prev {
+		spoolDropsTotal.WithLabelValues(c.queue).Add(float64(total - prev))
+	}
+}
+
 func (c *Client) Close() {
-	if c.channel != nil {
-		_ = c.channel.Close()
+	if c.drainStop != nil {
+		close(c.drainStop)
+		c.drainWG.Wait()
+	}
+	if c.spool != nil {
+		_ = c.spool.Close()
+	}
+
+	c.connMu.RLock()
+	ch, conn := c.channel, c.conn
+	c.connMu.RUnlock()
+	if ch != nil {
+		_ = ch.Close()
 	}
-	if c.conn != nil {
-		_ = c.conn.Close()
+	if conn != nil {
+		_ = conn.Close()
 	}
 }
 
-func LoadTLSConfig(useTLS, useMTLS bool) (*tls.Config, error) {
+// Default certificate paths used when a publish target doesn't set its own
+// PUBLISH_TARGET_<NAME>_TLS_* env vars, preserving the single shared
+// cert/key/CA this package used before targets could configure their own.
+const (
+	defaultTLSCertPath = "/etc/certs/client.crt"
+	defaultTLSKeyPath  = "/etc/certs/client.key"
+	defaultTLSCAPath   = "/etc/certs/ca.crt"
+)
+
+// LoadTLSConfig builds a tls.Config for a publish target. certPath/keyPath/
+// caPath let each target use its own materials (e.g. two TLS-enabled
+// targets with different CAs); any left empty fall back to the shared
+// default paths under /etc/certs.
+func LoadTLSConfig(useTLS, useMTLS bool, certPath, keyPath, caPath string) (*tls.Config, error) {
 	if !useTLS {
 		return nil, nil
 	}
+	if certPath == "" {
+		certPath = defaultTLSCertPath
+	}
+	if keyPath == "" {
+		keyPath = defaultTLSKeyPath
+	}
+	if caPath == "" {
+		caPath = defaultTLSCAPath
+	}
 
 	cfg := &tls.Config{}
 
 	if useMTLS {
-		cert, err := tls.LoadX509KeyPair("/etc/certs/client.crt", "/etc/certs/client.key")
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load client certs: %w", err)
 		}
 		cfg.Certificates = []tls.Certificate{cert}
 	}
 
-	caCert, err := os.ReadFile("/etc/certs/ca.crt")
+	caCert, err := os.ReadFile(caPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read CA cert: %w", err)
 	}
@@ -0,0 +1,86 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"go-temp/spool"
+)
+
+func TestShouldReconnect(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		healthy bool
+		want    bool
+	}{
+		{"ErrClosed always reconnects", amqp.ErrClosed, true, true},
+		{"unhealthy connection reconnects even without ErrClosed", errors.New("publish nacked by broker"), false, true},
+		{"healthy connection with a plain nack does not reconnect", errors.New("publish nacked by broker"), true, false},
+		{"context cancellation is the caller giving up, not reconnect", context.Canceled, false, false},
+		{"context deadline is the caller giving up, not reconnect", context.DeadlineExceeded, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shouldReconnect(tc.err, tc.healthy); got != tc.want {
+				t.Errorf("shouldReconnect(%v, healthy=%v) = %v, want %v", tc.err, tc.healthy, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfirmSlotBlocksWhenWindowFull(t *testing.T) {
+	c := &Client{confirmSem: make(chan struct{}, 1)}
+
+	if err := c.acquireConfirmSlot(context.Background()); err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.acquireConfirmSlot(ctx); err == nil {
+		t.Fatal("acquireConfirmSlot should block and time out once the confirm window is full")
+	}
+
+	c.releaseConfirmSlot()
+	if err := c.acquireConfirmSlot(context.Background()); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+func TestReportSpoolMetricsTracksDropsAsADelta(t *testing.T) {
+	s, err := spool.Open(spool.Config{
+		Dir:             t.TempDir(),
+		MaxSegmentBytes: 9, // force a new segment per record (8-byte header + 1 byte payload)
+		MaxFiles:        1,
+	})
+	if err != nil {
+		t.Fatalf("spool.Open: %v", err)
+	}
+	defer s.Close()
+
+	c := &Client{queue: "chunk0-4-test-queue", spool: s}
+
+	_ = s.Append([]byte{0})
+	c.reportSpoolMetrics()
+	if got := testutil.ToFloat64(spoolDropsTotal.WithLabelValues(c.queue)); got != 0 {
+		t.Fatalf("spool_drops_total after first append = %v, want 0", got)
+	}
+
+	_ = s.Append([]byte{1}) // MaxFiles:1 evicts the first segment, dropping its record
+	c.reportSpoolMetrics()
+	if got := testutil.ToFloat64(spoolDropsTotal.WithLabelValues(c.queue)); got != 1 {
+		t.Fatalf("spool_drops_total after eviction = %v, want 1", got)
+	}
+
+	// A second report with no new drops must not double-count.
+	c.reportSpoolMetrics()
+	if got := testutil.ToFloat64(spoolDropsTotal.WithLabelValues(c.queue)); got != 1 {
+		t.Fatalf("spool_drops_total after redundant report = %v, want still 1", got)
+	}
+}
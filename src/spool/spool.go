@@ -0,0 +1,391 @@
+// Package spool implements a small append-only, segmented on-disk queue
+// used to hold payloads that couldn't be published because the broker was
+// unreachable. Segments are capped in size and the oldest ones are
+// evicted once configured file/byte limits are exceeded, so a sensor that
+// loses connectivity for an extended period degrades by dropping its
+// oldest backlog rather than filling the disk.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+	recordHeader  = 8 // 4 bytes length + 4 bytes crc32
+)
+
+// Config controls segment sizing and retention.
+type Config struct {
+	// Dir is the directory segments are written under. It is created if
+	// it doesn't exist.
+	Dir string
+	// MaxSegmentBytes caps how large a single segment grows before a new
+	// one is started. Defaults to 16 MiB.
+	MaxSegmentBytes int64
+	// MaxFiles caps the number of segment files retained on disk. 0 means
+	// unlimited.
+	MaxFiles int
+	// MaxBytes caps the total size of all segments on disk. 0 means
+	// unlimited.
+	MaxBytes int64
+	// Fsync calls File.Sync after every append when true, trading
+	// throughput for a stronger durability guarantee.
+	Fsync bool
+}
+
+// Spool is a durable, ordered queue of not-yet-published payloads.
+type Spool struct {
+	cfg Config
+
+	mu       sync.Mutex
+	segments []*segment
+	active   *segment
+	// draining is the segment Drain last peeked a payload from and is
+	// currently awaiting publish for, released back to nil once that
+	// publish completes. evictLocked must never evict it: Drain releases
+	// s.mu between peekLocked returning a payload and re-acquiring it to
+	// record the publish outcome, and a concurrent Append (e.g. another
+	// client goroutine's reconnectWithBackoff falling back to the spool
+	// while the broker is flapping) can call evictLocked in that window.
+	// Without this, a segment mid-publish could be deleted out from under
+	// Drain and its still-in-flight (or already-succeeded) record counted
+	// as a drop.
+	draining *segment
+
+	drops uint64
+}
+
+type segment struct {
+	seq     int64
+	path    string
+	file    *os.File
+	size    int64
+	records int64
+	// drained is how many records from the front of this segment have
+	// already been published; once it equals records the segment is
+	// exhausted and can be removed.
+	drained int64
+}
+
+// Open opens (creating if necessary) the spool directory in cfg.Dir and
+// indexes any existing segments so previously spooled records survive a
+// restart.
+func Open(cfg Config) (*Spool, error) {
+	if cfg.MaxSegmentBytes <= 0 {
+		cfg.MaxSegmentBytes = 16 << 20
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("spool: create dir: %w", err)
+	}
+
+	s := &Spool{cfg: cfg}
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) loadSegments() error {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("spool: read dir: %w", err)
+	}
+
+	var segments []*segment
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), segmentPrefix) || filepath.Ext(e.Name()) != segmentSuffix {
+			continue
+		}
+
+		var seq int64
+		if _, err := fmt.Sscanf(e.Name(), segmentPrefix+"%020d"+segmentSuffix, &seq); err != nil {
+			continue
+		}
+
+		path := filepath.Join(s.cfg.Dir, e.Name())
+		seg, err := indexSegment(seq, path)
+		if err != nil {
+			return fmt.Errorf("spool: index %s: %w", path, err)
+		}
+		segments = append(segments, seg)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	s.segments = segments
+	return nil
+}
+
+// indexSegment scans a segment file to recover its record/byte counts.
+// Segments are small (MaxSegmentBytes-capped) so a full scan on startup
+// is cheap. A short trailing record - a partial header or payload left by
+// a crash between fsyncs (Fsync defaults to false) - is dropped rather
+// than treated as an error, since surviving exactly that crash is the
+// point of the spool; truncating it leaves the file holding only whole
+// records. Segments loaded here are never appended to again: the first
+// Append after Open starts a new segment.
+func indexSegment(seq int64, path string) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{seq: seq, path: path, file: f}
+	r := bufio.NewReader(f)
+	var header [recordHeader]byte
+	var validSize int64
+scan:
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			switch err {
+			case io.EOF, io.ErrUnexpectedEOF:
+				break scan
+			default:
+				return nil, err
+			}
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if _, err := r.Discard(int(length)); err != nil {
+			break scan
+		}
+		seg.size += int64(recordHeader) + int64(length)
+		seg.records++
+		validSize = seg.size
+	}
+
+	if err := f.Truncate(validSize); err != nil {
+		return nil, fmt.Errorf("truncate short trailing record: %w", err)
+	}
+	if _, err := f.Seek(validSize, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek after truncate: %w", err)
+	}
+
+	return seg, nil
+}
+
+// Append writes payload to the active segment, rolling to a new segment
+// when the size cap is reached, then enforces retention limits.
+func (s *Spool) Append(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil || s.active.size >= s.cfg.MaxSegmentBytes {
+		seg, err := s.newSegment()
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.active = seg
+	}
+
+	var header [recordHeader]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+
+	if _, err := s.active.file.Write(header[:]); err != nil {
+		return fmt.Errorf("spool: write header: %w", err)
+	}
+	if _, err := s.active.file.Write(payload); err != nil {
+		return fmt.Errorf("spool: write payload: %w", err)
+	}
+	if s.cfg.Fsync {
+		if err := s.active.file.Sync(); err != nil {
+			return fmt.Errorf("spool: fsync: %w", err)
+		}
+	}
+
+	s.active.size += int64(recordHeader) + int64(len(payload))
+	s.active.records++
+
+	s.evictLocked()
+	return nil
+}
+
+func (s *Spool) newSegment() (*segment, error) {
+	var seq int64
+	if n := len(s.segments); n > 0 {
+		seq = s.segments[n-1].seq + 1
+	}
+
+	path := filepath.Join(s.cfg.Dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("spool: create segment: %w", err)
+	}
+	return &segment{seq: seq, path: path, file: f}, nil
+}
+
+// evictLocked drops the oldest segments until the configured MaxFiles and
+// MaxBytes limits are satisfied. It stops early at the active segment or
+// the segment Drain is mid-publish for, so the limits can stay exceeded
+// until a later call. Callers must hold s.mu.
+func (s *Spool) evictLocked() {
+	for len(s.segments) > 0 && s.segments[0] != s.active && s.segments[0] != s.draining && s.overLimitLocked() {
+		oldest := s.segments[0]
+		_ = oldest.file.Close()
+		_ = os.Remove(oldest.path)
+		s.drops += uint64(oldest.records - oldest.drained)
+		s.segments = s.segments[1:]
+	}
+}
+
+func (s *Spool) overLimitLocked() bool {
+	if s.cfg.MaxFiles > 0 && len(s.segments) > s.cfg.MaxFiles {
+		return true
+	}
+	if s.cfg.MaxBytes > 0 && s.bytesLocked() > s.cfg.MaxBytes {
+		return true
+	}
+	return false
+}
+
+func (s *Spool) bytesLocked() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Drain publishes spooled records in order via publish, stopping at the
+// first failure (or ctx cancellation) so records aren't reordered or
+// skipped. Fully-drained segments are removed from disk.
+func (s *Spool) Drain(ctx context.Context, publish func(ctx context.Context, payload []byte) error) error {
+	for {
+		payload, seg, err := s.peekLocked()
+		if err != nil {
+			return err
+		}
+		if payload == nil {
+			return nil // nothing left to drain
+		}
+
+		publishErr := publish(ctx, payload)
+
+		s.mu.Lock()
+		if s.draining == seg {
+			s.draining = nil
+		}
+		if publishErr != nil {
+			s.mu.Unlock()
+			return publishErr
+		}
+		seg.drained++
+		if seg.drained >= seg.records && seg != s.active {
+			_ = seg.file.Close()
+			_ = os.Remove(seg.path)
+			s.removeSegmentLocked(seg)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Spool) removeSegmentLocked(target *segment) {
+	for i, seg := range s.segments {
+		if seg == target {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			return
+		}
+	}
+}
+
+// peekLocked returns the next undrained payload and the segment it came
+// from, or a nil payload if the spool is empty.
+func (s *Spool) peekLocked() ([]byte, *segment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		if seg.drained >= seg.records {
+			continue
+		}
+
+		if _, err := seg.file.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, fmt.Errorf("spool: seek: %w", err)
+		}
+		r := bufio.NewReader(seg.file)
+
+		var header [recordHeader]byte
+		for i := int64(0); i < seg.drained; i++ {
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				return nil, nil, fmt.Errorf("spool: skip record: %w", err)
+			}
+			length := binary.BigEndian.Uint32(header[:4])
+			if _, err := r.Discard(int(length)); err != nil {
+				return nil, nil, fmt.Errorf("spool: skip record: %w", err)
+			}
+		}
+
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, nil, fmt.Errorf("spool: read record: %w", err)
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		wantCRC := binary.BigEndian.Uint32(header[4:])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, nil, fmt.Errorf("spool: read payload: %w", err)
+		}
+		if crc32.ChecksumIEEE(payload) != wantCRC {
+			return nil, nil, fmt.Errorf("spool: crc mismatch in %s at record %d", seg.path, seg.drained)
+		}
+
+		s.draining = seg
+		return payload, seg, nil
+	}
+
+	return nil, nil, nil
+}
+
+// Bytes returns the total size in bytes of all segments currently on disk.
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytesLocked()
+}
+
+// Records returns the total number of undrained records across all
+// segments.
+func (s *Spool) Records() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.records - seg.drained
+	}
+	return total
+}
+
+// Drops returns the number of records discarded because retention limits
+// evicted their segment before they were drained.
+func (s *Spool) Drops() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drops
+}
+
+// Close closes all open segment files.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		if err := seg.file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,21 +1,51 @@
 package utils
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func SetupFileLogger(path string) error {
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+// NewLogger builds a JSON structured logger that writes to path, rotating
+// the file by size/age/backup count via lumberjack. The log level is
+// controlled by LOG_LEVEL (debug|info|warn|error, default info) and
+// rotation by LOG_MAX_SIZE_MB, LOG_MAX_BACKUPS, and LOG_MAX_AGE_DAYS.
+func NewLogger(path string) (*slog.Logger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	rotator := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    envInt("LOG_MAX_SIZE_MB", 100),
+		MaxBackups: envInt("LOG_MAX_BACKUPS", 5),
+		MaxAge:     envInt("LOG_MAX_AGE_DAYS", 28),
+	}
+
+	handler := slog.NewJSONHandler(rotator, &slog.HandlerOptions{Level: parseLevel(os.Getenv("LOG_LEVEL"))})
+	return slog.New(handler), nil
+}
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
 	}
+}
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return err
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
 	}
-	log.SetOutput(f)
-	return nil
+	return def
 }